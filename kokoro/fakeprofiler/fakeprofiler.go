@@ -0,0 +1,225 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakeprofiler implements a minimal in-process fake of the Cloud
+// Profiler API's CreateProfile/UpdateProfile handshake. It exists so the
+// e2e suite can exercise the agent's registration, upload, and backoff
+// paths locally, without GCE instances or real GCP credentials.
+package fakeprofiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Profile mirrors the subset of the Cloud Profiler API's Profile resource
+// that the agent creates and later uploads.
+type Profile struct {
+	Name         string            `json:"name"`
+	ProfileType  string            `json:"profileType"`
+	Labels       map[string]string `json:"labels"`
+	ProfileBytes []byte            `json:"profileBytes"`
+}
+
+// Server is a fake Cloud Profiler backend. It implements just enough of
+// CreateProfile and UpdateProfile for the agent to complete its handshake
+// and upload path end-to-end, and records everything it sees so tests can
+// assert against it.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	nextID        int
+	created       []*Profile
+	uploaded      []*Profile
+	forceBackoffN int
+}
+
+// New starts a fake Cloud Profiler backend listening on an ephemeral
+// localhost port. Callers must Close it when done.
+func New() *Server {
+	s := &Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/projects/", s.handle)
+	mux.HandleFunc("/$discovery/rest", s.serveDiscoveryDoc)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// discoveryDocTemplate is a trimmed-down Google API Discovery Service
+// document for the Cloud Profiler v2 API: just enough of the
+// projects.profiles.create/patch method descriptions for
+// googleapiclient.discovery.build() to construct a working client against
+// this fake, which is what googlecloudprofiler.start(discovery_service_url=...)
+// does before it can call CreateProfile/UpdateProfile.
+const discoveryDocTemplate = `{
+  "kind": "discovery#restDescription",
+  "discoveryVersion": "v1",
+  "id": "cloudprofiler:v2",
+  "name": "cloudprofiler",
+  "version": "v2",
+  "rootUrl": "%s/",
+  "servicePath": "",
+  "resources": {
+    "projects": {
+      "resources": {
+        "profiles": {
+          "methods": {
+            "create": {
+              "id": "cloudprofiler.projects.profiles.create",
+              "path": "v2/{+parent}/profiles",
+              "httpMethod": "POST",
+              "parameters": {
+                "parent": {
+                  "location": "path",
+                  "required": true,
+                  "type": "string"
+                }
+              },
+              "parameterOrder": ["parent"],
+              "request": {"$ref": "Profile"},
+              "response": {"$ref": "Profile"}
+            },
+            "patch": {
+              "id": "cloudprofiler.projects.profiles.patch",
+              "path": "v2/{+name}",
+              "httpMethod": "PATCH",
+              "parameters": {
+                "name": {
+                  "location": "path",
+                  "required": true,
+                  "type": "string"
+                }
+              },
+              "parameterOrder": ["name"],
+              "request": {"$ref": "Profile"},
+              "response": {"$ref": "Profile"}
+            }
+          }
+        }
+      }
+    }
+  },
+  "schemas": {
+    "Profile": {
+      "id": "Profile",
+      "type": "object",
+      "properties": {
+        "name": {"type": "string"},
+        "profileType": {"type": "string"},
+        "labels": {"type": "object"},
+        "profileBytes": {"type": "string", "format": "byte"}
+      }
+    }
+  }
+}`
+
+// serveDiscoveryDoc serves the discovery document agent's
+// discovery_service_url points at, so googleapiclient can build a client
+// against this fake before making any CreateProfile/UpdateProfile calls.
+func (s *Server) serveDiscoveryDoc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, discoveryDocTemplate, s.URL)
+}
+
+// SetForceBackoff makes the fake respond to the next n CreateProfile
+// requests with a throttled (HTTP 429) response, simulating the backoff
+// the real service returns when too many agents are registered at once.
+func (s *Server) SetForceBackoff(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forceBackoffN = n
+}
+
+// CreatedProfiles returns, in creation order, the profiles handed out by
+// CreateProfile so far.
+func (s *Server) CreatedProfiles() []*Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Profile(nil), s.created...)
+}
+
+// UploadedProfiles returns, in upload order, the profiles the agent has
+// sent to UpdateProfile so far.
+func (s *Server) UploadedProfiles() []*Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Profile(nil), s.uploaded...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.createProfile(w, r)
+	case http.MethodPatch:
+		s.updateProfile(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("fakeprofiler: unsupported method %s", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) createProfile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.forceBackoffN > 0 {
+		s.forceBackoffN--
+		http.Error(w, "generic::aborted: action throttled, backoff for 1s", http.StatusTooManyRequests)
+		return
+	}
+
+	var req struct {
+		ProfileType []string          `json:"profileType"`
+		Labels      map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.nextID++
+	p := &Profile{
+		// r.URL.Path is /v2/{parent}/profiles, so the name is
+		// {parent}/profiles/{id} and the agent's later PATCH to v2/{+name}
+		// is routed back to handle.
+		Name:   fmt.Sprintf("%s/%d", strings.TrimPrefix(r.URL.Path, "/v2/"), s.nextID),
+		Labels: req.Labels,
+	}
+	if len(req.ProfileType) > 0 {
+		p.ProfileType = req.ProfileType[0]
+	}
+	s.created = append(s.created, p)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *Server) updateProfile(w http.ResponseWriter, r *http.Request) {
+	var p Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.uploaded = append(s.uploaded, &p)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/profiler/proftest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gkeClusterEnv    = "GCLOUD_TESTS_PYTHON_GKE_CLUSTER"
+	gkeTestTimeout   = 20 * time.Minute
+	gkeBenchDuration = 600 * time.Second
+)
+
+// gkeDockerfileTemplate builds the image TestAgentIntegrationGKE deploys:
+// it installs the wheel fetched from gcsLocation into BaseImage and runs
+// the same bench.py the GCE runner uses, rendered from benchAppTemplate.
+const gkeDockerfileTemplate = `
+FROM {{.BaseImage}}
+COPY agent /tmp/agent
+COPY bench.py /bench.py
+RUN {{.PythonCommand}} -m pip install --ignore-installed /tmp/agent/google_cloud_profiler*
+ENTRYPOINT ["{{.PythonCommand}}", "/bench.py"]
+`
+
+// gkeTestCase describes one base image to run the agent under on GKE. It
+// intentionally reuses the wantProfiles shape from testCase so
+// checkWantProfiles works against both runners unmodified.
+type gkeTestCase struct {
+	name          string
+	namespace     string
+	baseImage     string
+	pythonCommand string
+	versionCheck  string
+	wantProfiles  map[string]string
+	// See testCase.wantProfileAsserts.
+	wantProfileAsserts map[string]ProfileAssertion
+}
+
+// gkeBaseImages maps the Python minor versions the GKE matrix covers to
+// the base image tagged with that version, for each image family. Both
+// 3.10 and 3.11 are exercised on both families to catch container-specific
+// regressions like missing /proc fields or PID-namespace differences that
+// a plain Ubuntu GCE VM wouldn't surface.
+var gkeBaseImages = map[int]struct {
+	distroless string
+	slim       string
+}{
+	10: {distroless: "gcr.io/distroless/python3-debian11:3.10", slim: "python:3.10-slim"},
+	11: {distroless: "gcr.io/distroless/python3-debian11:3.11", slim: "python:3.11-slim"},
+}
+
+// gkeTestCases returns one case per (Python minor version, base image)
+// pair the GKE matrix covers.
+func gkeTestCases() []gkeTestCase {
+	wantProfiles := map[string]string{
+		"WALL": "repeat_bench",
+		"CPU":  "repeat_bench",
+	}
+	wantProfileAsserts := map[string]ProfileAssertion{
+		"CPU": {
+			MinTotalSamples:       1,
+			CumulativeFunc:        "repeat_bench",
+			MinCumulativeFraction: 0.7,
+			WantLabels: map[string]string{
+				"language": "python",
+			},
+		},
+	}
+
+	var tcs []gkeTestCase
+	for _, minorVersion := range []int{10, 11} {
+		images := gkeBaseImages[minorVersion]
+		versionCheck := fmt.Sprintf("sys.version_info[:2] == (3, %d)", minorVersion)
+		tcs = append(tcs,
+			gkeTestCase{
+				name:               fmt.Sprintf("profiler-test-gke-distroless-py3%d-%s", minorVersion, runID),
+				namespace:          fmt.Sprintf("profiler-test-gke-distroless-py3%d-%s", minorVersion, runID),
+				baseImage:          images.distroless,
+				pythonCommand:      "python3",
+				versionCheck:       versionCheck,
+				wantProfiles:       wantProfiles,
+				wantProfileAsserts: wantProfileAsserts,
+			},
+			gkeTestCase{
+				name:               fmt.Sprintf("profiler-test-gke-slim-py3%d-%s", minorVersion, runID),
+				namespace:          fmt.Sprintf("profiler-test-gke-slim-py3%d-%s", minorVersion, runID),
+				baseImage:          images.slim,
+				pythonCommand:      "python3",
+				versionCheck:       versionCheck,
+				wantProfiles:       wantProfiles,
+				wantProfileAsserts: wantProfileAsserts,
+			},
+		)
+	}
+	return tcs
+}
+
+// renderGKEImageInputs renders both bench.py and the Dockerfile for tc,
+// using the same benchAppTemplate the GCE runner embeds in its startup
+// script, so the GKE and GCE runners exercise identical application code.
+func renderGKEImageInputs(tc gkeTestCase) (benchApp, dockerfile []byte, err error) {
+	benchTmpl, err := template.New("benchapp").Parse(benchAppTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse bench app template: %v", err)
+	}
+	var benchBuf bytes.Buffer
+	benchParams := struct {
+		Service      string
+		VersionCheck string
+		DurationSec  int
+	}{
+		Service:      tc.name,
+		VersionCheck: tc.versionCheck,
+		DurationSec:  int(gkeBenchDuration.Seconds()),
+	}
+	if err := benchTmpl.ExecuteTemplate(&benchBuf, "benchapp", benchParams); err != nil {
+		return nil, nil, fmt.Errorf("failed to render bench app: %v", err)
+	}
+
+	dockerTmpl, err := template.New("dockerfile").Parse(gkeDockerfileTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse Dockerfile template: %v", err)
+	}
+	var dockerBuf bytes.Buffer
+	dockerParams := struct {
+		BaseImage     string
+		PythonCommand string
+	}{
+		BaseImage:     tc.baseImage,
+		PythonCommand: tc.pythonCommand,
+	}
+	if err := dockerTmpl.Execute(&dockerBuf, dockerParams); err != nil {
+		return nil, nil, fmt.Errorf("failed to render Dockerfile: %v", err)
+	}
+
+	return benchBuf.Bytes(), dockerBuf.Bytes(), nil
+}
+
+// TestAgentIntegrationGKE runs the bench app inside a Kubernetes Pod on
+// GKE rather than directly on a GCE VM, to catch container-specific
+// regressions the Ubuntu-VM matrix in generateTestCases can't see. It
+// builds an image containing the wheel from gcsLocation, pushes it to
+// Artifact Registry, applies a Job manifest, tails the Pod's logs for
+// benchFinishString, and then queries profiles filtered by the GKE
+// resource labels (cluster, namespace, pod).
+func TestAgentIntegrationGKE(t *testing.T) {
+	projectID := os.Getenv("GCLOUD_TESTS_PYTHON_PROJECT_ID")
+	if projectID == "" {
+		t.Fatalf("Getenv(GCLOUD_TESTS_PYTHON_PROJECT_ID) got empty string")
+	}
+
+	cluster := os.Getenv(gkeClusterEnv)
+	if cluster == "" {
+		t.Fatalf("Getenv(%s) got empty string", gkeClusterEnv)
+	}
+
+	if *gcsLocation == "" {
+		t.Fatal("gcsLocation flag is not set")
+	}
+
+	ctx := context.Background()
+
+	client, err := google.DefaultClient(ctx, cloudScope)
+	if err != nil {
+		t.Fatalf("failed to get default client: %v", err)
+	}
+
+	gkeTr := proftest.GKETestRunner{
+		TestRunner: proftest.TestRunner{
+			Client: client,
+		},
+		Cluster: cluster,
+	}
+
+	testcases := gkeTestCases()
+
+	for _, tc := range testcases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			benchApp, dockerfile, err := renderGKEImageInputs(tc)
+			if err != nil {
+				t.Fatalf("failed to render GKE image inputs: %v", err)
+			}
+
+			image, err := gkeTr.BuildAndPushImage(ctx, proftest.GKEImageSpec{
+				Dockerfile:  dockerfile,
+				BuildFiles:  map[string][]byte{"bench.py": benchApp},
+				GCSLocation: *gcsLocation,
+				Tag:         fmt.Sprintf("gcr.io/%s/profiler-test/%s", projectID, tc.name),
+			})
+			if err != nil {
+				t.Fatalf("failed to build and push image: %v", err)
+			}
+
+			podName, err := gkeTr.Deploy(ctx, proftest.GKEDeploySpec{
+				Namespace: tc.namespace,
+				Image:     image,
+				Labels:    map[string]string{"service": tc.name},
+			})
+			if err != nil {
+				t.Fatalf("failed to deploy to GKE: %v", err)
+			}
+			defer func() {
+				if err := gkeTr.Cleanup(ctx, tc.namespace); err != nil {
+					t.Errorf("failed to clean up GKE namespace %s: %v", tc.namespace, err)
+				}
+			}()
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, gkeTestTimeout)
+			defer cancel()
+			if err := gkeTr.TailPodLogsUntil(timeoutCtx, tc.namespace, podName, benchFinishString, errorString, t.Logf); err != nil {
+				t.Fatal(err)
+			}
+
+			timeNow := time.Now()
+			endTime := timeNow.Format(time.RFC3339)
+			startTime := timeNow.Add(-1 * time.Hour).Format(time.RFC3339)
+			query := func(pType string) (*proftest.ProfileResponse, error) {
+				return gkeTr.TestRunner.QueryProfilesWithLabels(projectID, tc.name, startTime, endTime, pType, map[string]string{
+					"cluster":   cluster,
+					"namespace": tc.namespace,
+					"pod":       podName,
+				})
+			}
+			checkWantProfiles(t, tc.wantProfiles, query)
+			checkProfileAsserts(t, tc.wantProfileAsserts, query)
+		})
+	}
+}
@@ -19,19 +19,30 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"text/template"
 	"time"
 
 	"cloud.google.com/go/profiler/proftest"
+	"github.com/google/pprof/profile"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 
 	compute "google.golang.org/api/compute/v1"
+
+	"github.com/GoogleCloudPlatform/cloud-profiler-python/kokoro/fakeprofiler"
 )
 
+// throughputRE matches the "iterations/sec: <float>" lines bench.py prints
+// after each run, in the style of the "images/sec:" tagged lines common to
+// ML training benchmarks.
+var throughputRE = regexp.MustCompile(`iterations/sec: ([0-9.]+)`)
+
 var (
 	gcsLocation       = flag.String("gcs_location", "", "GCS location for the agent")
 	runBackoffTest    = flag.Bool("run_backoff_test", false, "Enables the backoff integration test. This integration test requires over 45 mins to run, so it is not run by default.")
@@ -40,6 +51,19 @@ var (
 	errorString       = "failed to set up or run the benchmark"
 )
 
+// emulatorHostEnv gates TestAgentIntegrationEmulator, a separate test from
+// TestAgentIntegration/generateTestCases: when set, that test points the
+// agent at a locally-run fake Profiler backend (see the fakeprofiler
+// package) instead of a real GCE VM, mirroring the FIRESTORE_EMULATOR_HOST
+// opt-in used by the Firestore client libraries. Unset, it's skipped.
+const emulatorHostEnv = "PROFILER_EMULATOR_HOST"
+
+// emulatorBackoffCountEnv, when set to a positive integer, tells the fake
+// backend started for TestAgentIntegrationEmulator to force that many
+// CreateProfile calls to be throttled before succeeding, so the backoff
+// path can be exercised without the 45-minute real-GCE backoff test.
+const emulatorBackoffCountEnv = "PROFILER_EMULATOR_BACKOFF_COUNT"
+
 const (
 	cloudScope       = "https://www.googleapis.com/auth/cloud-platform"
 	storageReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
@@ -58,6 +82,48 @@ const (
 	backoffTestTimeout   = 60 * time.Minute
 )
 
+// benchAppTemplate is the bench.py application both the GCE startup
+// script (via the "setup" template below) and TestAgentIntegrationGKE's
+// container image render, so every runner exercises identical
+// application code and the wantProfiles/checkWantProfiles assertions mean
+// the same thing regardless of where the agent ran.
+const benchAppTemplate = `
+{{ define "benchapp" -}}
+import googlecloudprofiler
+import os
+import sys
+import time
+import traceback
+
+def python_bench():
+  for counter in range(1, 5000):
+    pass
+
+def repeat_bench(dur_sec):
+  t_end = time.time() + dur_sec
+  count = 0
+  while time.time() < t_end or dur_sec == 0:
+    python_bench()
+    count += 1
+  return count
+
+if __name__ == '__main__':
+  if not {{.VersionCheck}}:
+    raise EnvironmentError('Python version %s failed to satisfy "{{.VersionCheck}}".' % str(sys.version_info))
+
+  if os.environ.get('DISABLE_PROFILER') != '1':
+    try:
+      googlecloudprofiler.start(
+        service='{{.Service}}',
+        service_version='1.0.0',
+        verbose=3)
+    except BaseException:
+      sys.exit('Failed to start the profiler: %s' % traceback.format_exc())
+  count = repeat_bench({{.DurationSec}})
+  print('iterations/sec: %f' % (count / float({{.DurationSec}})))
+{{- end }}
+`
+
 const startupTemplate = `
 {{ define "setup"}}
 
@@ -83,49 +149,50 @@ retry wget -O /tmp/get-pip.py {{.GetPipURL}} >/dev/null
 retry {{.PythonCommand}} /tmp/get-pip.py >/dev/null
 retry {{.PythonCommand}} -m pip install --upgrade pyasn1 >/dev/null
 
-# Setup pipenv
+# Setup pipenv for the benchmark app.
 retry {{.PythonCommand}} -m pip install pipenv > /dev/null
 mkdir bench && cd bench
 retry pipenv install > /dev/null
-
+{{if .PinnedDeps}}
+# Pin the benchmark app's own dependencies, to prove the agent still works
+# when the user's app constrains transitive deps (protobuf, google-auth)
+# the agent would otherwise want newer versions of. The entries are inserted
+# right after the Pipfile's [packages] header.
+sed -i '/^\[packages\]$/r /dev/stdin' Pipfile << EOF
+{{.PinnedDeps}}
+EOF
+retry pipenv install > /dev/null
+{{end}}
 
 # Fetch agent.
 mkdir /tmp/agent
 retry gsutil cp gs://{{.GCSLocation}}/* /tmp/agent
 
-# Install agent.
-retry pipenv run {{.PythonCommand}} -m pip install --ignore-installed "$(find /tmp/agent -name "google_cloud_profiler*")"
+# Install the agent into its own isolated environment via pipx, rather
+# than into the pipenv environment above, so its transitive deps don't
+# co-mingle with whatever the benchmark app pins.
+retry {{.PythonCommand}} -m pip install --user pipx > /dev/null
+retry {{.PythonCommand}} -m pipx install --python {{.PythonCommand}} "$(find /tmp/agent -name "google_cloud_profiler*")"
+export PIPX_AGENT_VENV="$({{.PythonCommand}} -m pipx environment --value PIPX_LOCAL_VENVS)/google-cloud-profiler"
+export PIPX_AGENT_PYTHON="$PIPX_AGENT_VENV/bin/{{.PythonCommand}}"
+
+{{if .PinnedDeps}}
+# Also install the agent straight into the benchmark's own pinned pipenv
+# environment, so bench.py below runs it there, right alongside the
+# pinned protobuf/google-auth, rather than inside the pipx venv. A clean
+# run proves the agent tolerates the user's pins; it says nothing about
+# pipx isolation, which is exercised by every unpinned test case instead.
+# Packages already installed there are passed as constraints, so the pins
+# are kept rather than overwritten by the agent's own requirements.
+pipenv run {{.PythonCommand}} -m pip freeze > /tmp/pinned-constraints.txt
+retry pipenv run {{.PythonCommand}} -m pip install --constraint /tmp/pinned-constraints.txt "$(find /tmp/agent -name "google_cloud_profiler*")" > /dev/null
+{{end}}
 
 # Write bench app.
 export BENCH_DIR="$HOME/bench"
 
 cat << EOF > bench.py
-import googlecloudprofiler
-import sys
-import time
-import traceback
-
-def python_bench():
-  for counter in range(1, 5000):
-    pass
-
-def repeat_bench(dur_sec):
-  t_end = time.time() + dur_sec
-  while time.time() < t_end or dur_sec == 0:
-    python_bench()
-
-if __name__ == '__main__':
-  if not {{.VersionCheck}}:
-    raise EnvironmentError('Python version %s failed to satisfy "{{.VersionCheck}}".' % str(sys.version_info))
-
-  try:
-    googlecloudprofiler.start(
-      service='{{.Service}}',
-      service_version='1.0.0',
-      verbose=3)
-  except BaseException:
-    sys.exit('Failed to start the profiler: %s' % traceback.format_exc())
-  repeat_bench({{.DurationSec}})
+{{ template "benchapp" . }}
 EOF
 
 {{- end }}
@@ -134,8 +201,17 @@ EOF
 {{- template "prologue" . }}
 {{- template "setup" . }}
 
-# Run bench app.
+{{if .PinnedDeps}}
+# Run bench app inside the benchmark's own pinned pipenv environment,
+# where the agent was also installed above, so the pins actually apply
+# to the process that imports googlecloudprofiler.
 pipenv run {{.PythonCommand}} bench.py
+{{else}}
+# Run bench app with the pipx-isolated agent's own interpreter, so its
+# imports never fall back to whatever the benchmark's pipenv environment
+# provides.
+"$PIPX_AGENT_PYTHON" bench.py
+{{end}}
 
 # Indicate to test that script has finished running.
 echo "{{.FinishString}}"
@@ -152,7 +228,7 @@ set +x
 
 echo "Starting {{.NumBackoffBenchmarks}} benchmarks."
 for (( i = 0; i < {{.NumBackoffBenchmarks}}; i++ )); do
-	(pipenv run {{.PythonCommand}} bench.py) |& while read line; \
+	("$PIPX_AGENT_PYTHON" bench.py) |& while read line; \
 	     do echo "benchmark $i: ${line}"; done &
 done
 echo "Successfully started {{.NumBackoffBenchmarks}} benchmarks."
@@ -164,6 +240,23 @@ set -x
 
 echo "{{.FinishString}}"
 
+{{ template "epilogue" . -}}
+{{ end }}
+
+{{ define "overhead" -}}
+{{- template "prologue" . }}
+{{- template "setup" . }}
+
+# Run once without the profiler to get a baseline, then once with it, so
+# both throughput figures come from identically provisioned instances.
+echo "Running baseline benchmark without the profiler."
+DISABLE_PROFILER=1 "$PIPX_AGENT_PYTHON" bench.py
+
+echo "Running benchmark with the profiler."
+"$PIPX_AGENT_PYTHON" bench.py
+
+echo "{{.FinishString}}"
+
 {{ template "epilogue" . -}}
 {{ end }}
 `
@@ -183,17 +276,37 @@ type testCase struct {
 	// URL of the get-pip.py script, defaults to
 	// the value of https://bootstrap.pypa.io/get-pip.py when not specified.
 	getPipURL string
+	// Extra Pipfile entries to pin the benchmark app's own dependencies to,
+	// e.g. an older protobuf/google-auth. When set, the agent is installed
+	// into this pinned pipenv environment (in addition to its usual pipx
+	// venv) and bench.py is run there instead, to prove the agent still
+	// works under user-controlled dep versions. Empty string means no
+	// pinning, and bench.py runs under the pipx-isolated agent as usual.
+	pinnedDeps string
 	// Timeout for the integration test.
 	timeout time.Duration
 	// When true, a backoff test should be run. Otherwise, run a standard
 	// integration test.
 	backoffTest bool
+	// When true, an overhead test should be run instead of a standard
+	// integration test. Mutually exclusive with backoffTest.
+	overheadTest bool
+	// Stable key identifying this case's Python version across runs, e.g.
+	// "python3.10". Unlike name, it does not embed runID, so it's what
+	// overhead benchmark records and regression lookups are grouped by.
+	// Only used when overheadTest is true.
+	pythonVersionKey string
 	// Duration for which benchmark application should run.
 	benchDuration time.Duration
 	// Maps profile type to function name wanted for that type. Empty function
-	// name means the type should not be profiled. Only used when backoffTest is
-	// false.
+	// name means the type should not be profiled. Only used when backoffTest
+	// and overheadTest are both false.
 	wantProfiles map[string]string
+	// Maps profile type to richer correctness checks -- sample counts,
+	// cumulative weight, labels, stack depth -- to run against the
+	// downloaded pprof in addition to the presence check wantProfiles
+	// performs. Only used when backoffTest and overheadTest are both false.
+	wantProfileAsserts map[string]ProfileAssertion
 }
 
 func (tc *testCase) initializeStartUpScript(template *template.Template) error {
@@ -209,6 +322,7 @@ func (tc *testCase) initializeStartUpScript(template *template.Template) error {
 		ErrorString          string
 		DurationSec          int
 		NumBackoffBenchmarks int
+		PinnedDeps           string
 	}{
 		Service:              tc.name,
 		GCSLocation:          *gcsLocation,
@@ -220,12 +334,16 @@ func (tc *testCase) initializeStartUpScript(template *template.Template) error {
 		FinishString:         benchFinishString,
 		ErrorString:          errorString,
 		DurationSec:          int(tc.benchDuration.Seconds()),
+		PinnedDeps:           tc.pinnedDeps,
 	}
 
 	testTemplate := "integration"
-	if tc.backoffTest {
+	switch {
+	case tc.backoffTest:
 		testTemplate = "integration_backoff"
 		params.NumBackoffBenchmarks = numBackoffBenchmarks
+	case tc.overheadTest:
+		testTemplate = "overhead"
 	}
 
 	var buf bytes.Buffer
@@ -237,6 +355,152 @@ func (tc *testCase) initializeStartUpScript(template *template.Template) error {
 	return nil
 }
 
+// parseStartupTemplate parses startupTemplate together with
+// benchAppTemplate into a single template set, so "setup"'s
+// {{ template "benchapp" . }} resolves to the shared bench.py source.
+func parseStartupTemplate() (*template.Template, error) {
+	tmpl, err := proftest.BaseStartupTmpl.Parse(startupTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Parse(benchAppTemplate)
+}
+
+// checkWantProfiles asserts, for each profile type in wantProfiles, that a
+// profile containing (or, for an empty function name, not containing) the
+// named function was collected. query is called once per profile type and
+// should return the matching proftest.ProfileResponse; this lets
+// TestAgentIntegration and TestAgentIntegrationGKE share the same
+// assertions despite querying profiles by zone and by GKE labels
+// respectively.
+func checkWantProfiles(t *testing.T, wantProfiles map[string]string, query func(profileType string) (*proftest.ProfileResponse, error)) {
+	t.Helper()
+	for pType, function := range wantProfiles {
+		pr, err := query(pType)
+		if function == "" {
+			if err == nil {
+				t.Errorf("query(%s) got profile, want no profile", pType)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("query(%s) got error: %v", pType, err)
+			continue
+		}
+
+		if err := pr.HasFunction(function); err != nil {
+			t.Errorf("function %s not found in profiles of type %s: %v", function, pType, err)
+		}
+	}
+}
+
+// ProfileAssertion describes correctness checks to run against a
+// downloaded pprof profile beyond the "does this function appear
+// somewhere" check that wantProfiles performs. A profile can be
+// well-formed but empty or heavily truncated and still pass that check;
+// these bounds catch that class of regression.
+type ProfileAssertion struct {
+	// MinTotalSamples is the minimum total sample value the profile
+	// must contain, summed across all samples. Zero means unchecked.
+	MinTotalSamples int64
+	// CumulativeFunc, if non-empty, names a function whose own and
+	// descendant samples must account for at least
+	// MinCumulativeFraction of the profile's total sample value -- e.g.
+	// "repeat_bench" should dominate a pure-CPU workload's CPU profile.
+	CumulativeFunc        string
+	MinCumulativeFraction float64
+	// WantLabels are label key/value pairs, e.g. "service",
+	// "service_version", "language", that the Profile resource itself
+	// (proftest.ProfileResponse.Labels) must carry.
+	WantLabels map[string]string
+	// MaxStackDepth bounds the deepest stack any sample may report.
+	// Zero means unchecked.
+	MaxStackDepth int
+}
+
+// checkProfileAsserts downloads and parses the pprof for each profile type
+// in wantProfileAsserts via query, then applies the corresponding
+// ProfileAssertion.
+func checkProfileAsserts(t *testing.T, wantProfileAsserts map[string]ProfileAssertion, query func(profileType string) (*proftest.ProfileResponse, error)) {
+	t.Helper()
+	for pType, assertion := range wantProfileAsserts {
+		pr, err := query(pType)
+		if err != nil {
+			t.Errorf("query(%s) got error: %v", pType, err)
+			continue
+		}
+		checkProfileAssertion(t, pType, pr, assertion)
+	}
+}
+
+func checkProfileAssertion(t *testing.T, pType string, pr *proftest.ProfileResponse, assertion ProfileAssertion) {
+	t.Helper()
+
+	// service/service_version/language and the like are metadata on the
+	// Profile resource itself (returned alongside, not inside, the raw
+	// pprof bytes), so they're checked against pr.Labels rather than any
+	// per-sample pprof label.
+	for k, want := range assertion.WantLabels {
+		if got := pr.Labels[k]; got != want {
+			t.Errorf("profile type %s: resource label %s = %q, want %q", pType, k, got, want)
+		}
+	}
+
+	prof, err := profile.Parse(bytes.NewReader(pr.Profile))
+	if err != nil {
+		t.Errorf("failed to parse profile of type %s: %v", pType, err)
+		return
+	}
+
+	var total, cumulative int64
+	maxDepth := 0
+	for _, sample := range prof.Sample {
+		if len(sample.Value) == 0 {
+			continue
+		}
+		v := sample.Value[0]
+		total += v
+
+		if len(sample.Location) > maxDepth {
+			maxDepth = len(sample.Location)
+		}
+
+		if assertion.CumulativeFunc != "" && sampleHasFunction(sample, assertion.CumulativeFunc) {
+			cumulative += v
+		}
+	}
+
+	if assertion.MinTotalSamples > 0 && total < assertion.MinTotalSamples {
+		t.Errorf("profile type %s: got %d total samples, want at least %d", pType, total, assertion.MinTotalSamples)
+	}
+
+	if assertion.CumulativeFunc != "" && total > 0 {
+		fraction := float64(cumulative) / float64(total)
+		if fraction < assertion.MinCumulativeFraction {
+			t.Errorf("profile type %s: %s accounts for %.2f%% of samples, want at least %.2f%%",
+				pType, assertion.CumulativeFunc, fraction*100, assertion.MinCumulativeFraction*100)
+		}
+	}
+
+	if assertion.MaxStackDepth > 0 && maxDepth > assertion.MaxStackDepth {
+		t.Errorf("profile type %s: got stack depth %d, want at most %d", pType, maxDepth, assertion.MaxStackDepth)
+	}
+}
+
+// sampleHasFunction reports whether any location in sample's stack
+// resolves to a function named name.
+func sampleHasFunction(sample *profile.Sample, name string) bool {
+	for _, loc := range sample.Location {
+		for _, line := range loc.Line {
+			if line.Function != nil && line.Function.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func TestAgentIntegration(t *testing.T) {
 	projectID := os.Getenv("GCLOUD_TESTS_PYTHON_PROJECT_ID")
 	if projectID == "" {
@@ -263,7 +527,7 @@ func TestAgentIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to initialize compute Service: %v", err)
 	}
-	template, err := proftest.BaseStartupTmpl.Parse(startupTemplate)
+	template, err := parseStartupTemplate()
 	if err != nil {
 		t.Fatalf("failed to parse startup script template: %v", err)
 	}
@@ -312,28 +576,119 @@ func TestAgentIntegration(t *testing.T) {
 			timeNow := time.Now()
 			endTime := timeNow.Format(time.RFC3339)
 			startTime := timeNow.Add(-1 * time.Hour).Format(time.RFC3339)
-			for pType, function := range tc.wantProfiles {
-				pr, err := gceTr.TestRunner.QueryProfilesWithZone(tc.ProjectID, tc.name, startTime, endTime, pType, zone)
-				if function == "" {
-					if err == nil {
-						t.Errorf("QueryProfilesWithZone(%s, %s, %s, %s, %s, %s) got profile, want no profile", tc.ProjectID, tc.name, startTime, endTime, pType, zone)
-					}
-					continue
-				}
-
-				if err != nil {
-					t.Errorf("QueryProfiles(%s, %s, %s, %s, %s) got error: %v", tc.ProjectID, tc.name, startTime, endTime, pType, err)
-					continue
-				}
-
-				if err := pr.HasFunction(function); err != nil {
-					t.Errorf("Function %s not found in profiles of type %s: %v", function, pType, err)
-				}
+			query := func(pType string) (*proftest.ProfileResponse, error) {
+				return gceTr.TestRunner.QueryProfilesWithZone(tc.ProjectID, tc.name, startTime, endTime, pType, zone)
 			}
+			checkWantProfiles(t, tc.wantProfiles, query)
+			checkProfileAsserts(t, tc.wantProfileAsserts, query)
 		})
 	}
 }
 
+// emulatorBenchTemplate is a trimmed-down variant of the bench.py heredoc
+// in startupTemplate: it points googlecloudprofiler at the fake backend's
+// discovery_service_url instead of the real Profiler API, and disables SSL
+// authentication so no GCP credentials are required.
+const emulatorBenchTemplate = `
+import googlecloudprofiler
+import sys
+import time
+import traceback
+
+def python_bench():
+  for counter in range(1, 5000):
+    pass
+
+def repeat_bench(dur_sec):
+  t_end = time.time() + dur_sec
+  while time.time() < t_end:
+    python_bench()
+
+if __name__ == '__main__':
+  try:
+    googlecloudprofiler.start(
+      service='{{.Service}}',
+      service_version='1.0.0',
+      verbose=3,
+      discovery_service_url='http://{{.Host}}/$discovery/rest',
+      disable_ssl_authentication=True)
+  except BaseException:
+    sys.exit('Failed to start the profiler: %s' % traceback.format_exc())
+  repeat_bench({{.DurationSec}})
+  print('{{.FinishString}}')
+`
+
+// writeEmulatorBenchScript renders emulatorBenchTemplate to a temp file
+// pointed at host and returns its path. The caller is responsible for
+// removing it.
+func writeEmulatorBenchScript(host string) (string, error) {
+	tmpl, err := template.New("emulator-bench").Parse(emulatorBenchTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse emulator bench template: %v", err)
+	}
+
+	f, err := os.CreateTemp("", "emulator-bench-*.py")
+	if err != nil {
+		return "", fmt.Errorf("failed to create emulator bench script: %v", err)
+	}
+	defer f.Close()
+
+	params := struct {
+		Service      string
+		Host         string
+		DurationSec  int
+		FinishString string
+	}{
+		Service:      "profiler-test-emulator",
+		Host:         host,
+		DurationSec:  5,
+		FinishString: benchFinishString,
+	}
+	if err := tmpl.Execute(f, params); err != nil {
+		return "", fmt.Errorf("failed to render emulator bench script: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// TestAgentIntegrationEmulator runs the agent's full create/update/upload
+// handshake against an in-process fake Profiler backend rather than real
+// GCE VMs. It is opt-in via PROFILER_EMULATOR_HOST so it doesn't run
+// alongside the real integration tests, but lets contributors exercise the
+// same paths (including forced backoff) in seconds and without GCP
+// credentials.
+func TestAgentIntegrationEmulator(t *testing.T) {
+	if os.Getenv(emulatorHostEnv) == "" {
+		t.Skipf("%s not set; skipping local emulator test", emulatorHostEnv)
+	}
+
+	fake := fakeprofiler.New()
+	defer fake.Close()
+
+	if n, err := strconv.Atoi(os.Getenv(emulatorBackoffCountEnv)); err == nil && n > 0 {
+		fake.SetForceBackoff(n)
+	}
+
+	benchPath, err := writeEmulatorBenchScript(fake.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to write emulator bench script: %v", err)
+	}
+	defer os.Remove(benchPath)
+
+	cmd := exec.Command("python3", benchPath)
+	cmd.Env = os.Environ()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("bench.py failed: %v\noutput:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), benchFinishString) {
+		t.Fatalf("bench.py did not report completion, got output:\n%s", out)
+	}
+
+	if len(fake.UploadedProfiles()) == 0 {
+		t.Error("fake backend received no uploaded profiles, want at least one")
+	}
+}
+
 func generateTestCases(projectID, zone string) []testCase {
 	tcs := []testCase{
 		// Test GCE Ubuntu default Python 3, expect Python 3.10.
@@ -352,6 +707,18 @@ func generateTestCases(projectID, zone string) []testCase {
 				"WALL": "repeat_bench",
 				"CPU":  "repeat_bench",
 			},
+			wantProfileAsserts: map[string]ProfileAssertion{
+				"CPU": {
+					MinTotalSamples:       1,
+					CumulativeFunc:        "repeat_bench",
+					MinCumulativeFraction: 0.7,
+					WantLabels: map[string]string{
+						"service":         fmt.Sprintf("profiler-test-python3-%s-gce", runID),
+						"service_version": "1.0.0",
+						"language":        "python",
+					},
+				},
+			},
 			pythonCommand: "python3",
 			pythonDev:     "python3-dev",
 			versionCheck:  "sys.version_info[:2] == (3, 10)",
@@ -393,6 +760,35 @@ func generateTestCases(projectID, zone string) []testCase {
 		})
 	}
 
+	// Pin the benchmark app's own protobuf/google-auth to older versions,
+	// install the agent into that same pinned pipenv environment, and run
+	// bench.py there, to prove the agent still works when co-installed
+	// alongside a user app that constrains transitive deps it would
+	// otherwise want newer versions of.
+	tcs = append(tcs, testCase{
+		InstanceConfig: proftest.InstanceConfig{
+			ProjectID:    projectID,
+			Zone:         zone,
+			Name:         fmt.Sprintf("profiler-test-python3-pinned-deps-%s", runID),
+			MachineType:  "n1-standard-1",
+			ImageProject: "ubuntu-os-cloud",
+			ImageFamily:  "ubuntu-2204-lts",
+			Scopes:       []string{storageReadScope},
+		},
+		name: fmt.Sprintf("profiler-test-python3-pinned-deps-%s-gce", runID),
+		wantProfiles: map[string]string{
+			"WALL": "repeat_bench",
+			"CPU":  "repeat_bench",
+		},
+		pythonCommand: "python3",
+		pythonDev:     "python3-dev",
+		versionCheck:  "sys.version_info[:2] == (3, 10)",
+		getPipURL:     defaultGetPipURL,
+		timeout:       gceTestTimeout,
+		benchDuration: gceBenchDuration,
+		pinnedDeps:    "protobuf = \"==3.19.6\"\ngoogle-auth = \"==1.35.0\"",
+	})
+
 	if *runBackoffTest {
 		tcs = append(tcs, testCase{
 			// Test GCE Ubuntu default Python 3, expect Python 3.10.
@@ -426,3 +822,175 @@ func generateTestCases(projectID, zone string) []testCase {
 
 	return tcs
 }
+
+// overheadThreshold is the maximum fractional increase in agent overhead,
+// relative to the average of the last overheadSampleSize recorded runs,
+// that TestAgentOverhead tolerates before failing.
+const overheadThreshold = 0.05
+
+// overheadSampleSize is the number of most recent recorded runs averaged
+// together to form the baseline TestAgentOverhead compares against.
+const overheadSampleSize = 10
+
+// parseThroughputs extracts the two "iterations/sec:" lines the "overhead"
+// startup script produces -- the first from the run without the profiler,
+// the second from the run with it -- and returns (withProfiler,
+// withoutProfiler).
+func parseThroughputs(output string) (withProfiler, withoutProfiler float64, err error) {
+	matches := throughputRE.FindAllStringSubmatch(output, -1)
+	if len(matches) != 2 {
+		return 0, 0, fmt.Errorf("got %d iterations/sec lines in output, want 2", len(matches))
+	}
+
+	withoutProfiler, err = strconv.ParseFloat(matches[0][1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse baseline throughput %q: %v", matches[0][1], err)
+	}
+	withProfiler, err = strconv.ParseFloat(matches[1][1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse profiled throughput %q: %v", matches[1][1], err)
+	}
+	return withProfiler, withoutProfiler, nil
+}
+
+// TestAgentOverhead measures the throughput the agent costs a CPU-bound
+// workload and reports it alongside the commit under test, so a
+// proftest.BenchmarkReporter can flag PRs that regress agent performance
+// before merge. It runs against the same GCE images as TestAgentIntegration
+// but only with one case per supported Python 3 minor version, since
+// overhead should not vary with unrelated image features.
+func TestAgentOverhead(t *testing.T) {
+	projectID := os.Getenv("GCLOUD_TESTS_PYTHON_PROJECT_ID")
+	if projectID == "" {
+		t.Fatalf("Getenv(GCLOUD_TESTS_PYTHON_PROJECT_ID) got empty string")
+	}
+
+	zone := os.Getenv("GCLOUD_TESTS_PYTHON_ZONE")
+	if zone == "" {
+		t.Fatalf("Getenv(GCLOUD_TESTS_PYTHON_ZONE) got empty string")
+	}
+
+	if *gcsLocation == "" {
+		t.Fatal("gcsLocation flag is not set")
+	}
+
+	ctx := context.Background()
+
+	client, err := google.DefaultClient(ctx, cloudScope)
+	if err != nil {
+		t.Fatalf("failed to get default client: %v", err)
+	}
+
+	computeService, err := compute.New(client)
+	if err != nil {
+		t.Fatalf("failed to initialize compute Service: %v", err)
+	}
+	template, err := parseStartupTemplate()
+	if err != nil {
+		t.Fatalf("failed to parse startup script template: %v", err)
+	}
+
+	gceTr := proftest.GCETestRunner{
+		TestRunner: proftest.TestRunner{
+			Client: client,
+		},
+		ComputeService: computeService,
+	}
+
+	reporter, err := proftest.NewBenchmarkReporter(ctx)
+	if err != nil {
+		t.Fatalf("failed to initialize benchmark reporter: %v", err)
+	}
+
+	commitSHA := os.Getenv("KOKORO_GIT_COMMIT")
+
+	for _, tc := range overheadTestCases(projectID, zone) {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.overheadTest = true
+			if err := tc.initializeStartUpScript(template); err != nil {
+				t.Fatalf("failed to initialize startup script: %v", err)
+			}
+
+			gceTr.StartInstance(ctx, &tc.InstanceConfig)
+			defer func() {
+				if gceTr.DeleteInstance(ctx, &tc.InstanceConfig); err != nil {
+					t.Fatalf("failed to delete instance: %v", err)
+				}
+			}()
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, tc.timeout)
+			defer cancel()
+			output, err := gceTr.PollAndLogSerialPort(timeoutCtx, &tc.InstanceConfig, benchFinishString, errorString, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			withProfiler, withoutProfiler, err := parseThroughputs(output)
+			if err != nil {
+				t.Fatalf("failed to parse benchmark throughput: %v", err)
+			}
+
+			overhead := (withoutProfiler - withProfiler) / withoutProfiler
+			record := proftest.BenchmarkRecord{
+				CommitSHA:         commitSHA,
+				PythonVersion:     tc.pythonVersionKey,
+				MachineType:       tc.MachineType,
+				WithThroughput:    withProfiler,
+				WithoutThroughput: withoutProfiler,
+				OverheadPercent:   overhead * 100,
+			}
+			if err := reporter.Report(ctx, record); err != nil {
+				t.Errorf("failed to report benchmark record: %v", err)
+			}
+
+			avgOverhead, err := reporter.AverageOverhead(ctx, tc.pythonVersionKey, overheadSampleSize)
+			if err != nil {
+				t.Logf("no historical overhead average for %s, skipping regression check: %v", tc.pythonVersionKey, err)
+				return
+			}
+			if overhead > avgOverhead+overheadThreshold {
+				t.Errorf("overhead %.2f%% exceeds threshold: last %d runs averaged %.2f%%, allowed margin is %.2f%%",
+					overhead*100, overheadSampleSize, avgOverhead*100, overheadThreshold*100)
+			}
+		})
+	}
+}
+
+// overheadTestCases returns one testCase per supported Python 3 minor
+// version (3.7 through 3.11), each installed from deadsnakes, mirroring
+// generateTestCases' per-version loop; there is no default-interpreter,
+// pinned-deps or backoff variant.
+func overheadTestCases(projectID, zone string) []testCase {
+	var tcs []testCase
+	for _, minorVersion := range []int{7, 8, 9, 10, 11} {
+		getPipURL := defaultGetPipURL
+		// TODO: remove special case once 3.7 is dropped
+		if minorVersion == 7 {
+			getPipURL = "https://bootstrap.pypa.io/pip/3.7/get-pip.py"
+		}
+
+		tcs = append(tcs, testCase{
+			InstanceConfig: proftest.InstanceConfig{
+				ProjectID:    projectID,
+				Zone:         zone,
+				Name:         fmt.Sprintf("profiler-overhead-python3%d-%s", minorVersion, runID),
+				MachineType:  "n1-standard-1",
+				ImageProject: "ubuntu-os-cloud",
+				ImageFamily:  "ubuntu-2204-lts",
+				Scopes:       []string{storageReadScope},
+			},
+			name:                 fmt.Sprintf("profiler-overhead-python3%d-%s-gce", minorVersion, runID),
+			pythonVersionKey:     fmt.Sprintf("python3.%d", minorVersion),
+			installPythonVersion: fmt.Sprintf("python3.%d", minorVersion),
+			pythonCommand:        fmt.Sprintf("python3.%d", minorVersion),
+			getPipURL:            getPipURL,
+			pythonDev:            fmt.Sprintf("python3.%d-dev", minorVersion),
+			versionCheck:         fmt.Sprintf("sys.version_info[:2] >= (3, %d)", minorVersion),
+			timeout:              gceTestTimeout,
+			benchDuration:        gceBenchDuration,
+		})
+	}
+	return tcs
+}